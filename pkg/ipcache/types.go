@@ -4,8 +4,8 @@
 package ipcache
 
 import (
-	"bytes"
-	"sort"
+	"fmt"
+	"reflect"
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/exp/maps"
@@ -40,6 +40,17 @@ type resourceInfo struct {
 
 	tunnelPeer types.TunnelPeer
 	encryptKey types.EncryptKey
+
+	// priority breaks ties between two resourceInfo of the same source.
+	// It does not by itself mark a resourceInfo as valid; see its
+	// registration in init() below.
+	priority types.Priority
+
+	// extra holds any IPMetadata kind that was registered without a
+	// dedicated get/set pair (see RegisterMetadataKind), keyed by its
+	// concrete type. This is what lets a kind plug into merge(), unmerge()
+	// and isValid() without this struct needing a new field for it.
+	extra map[reflect.Type]IPMetadata
 }
 
 // IPMetadata is an empty interface intended to inform developers using the
@@ -52,55 +63,183 @@ type resourceInfo struct {
 // gets injected into the IPCache.
 type IPMetadata any
 
+// ipMetadataKind bundles together, for a single registered IPMetadata type,
+// everything merge(), unmerge(), isValid() and logConflicts() need in order
+// to handle it without knowing its concrete type. It is the type-erased
+// counterpart of the handlers passed to RegisterMetadataKind.
+type ipMetadataKind struct {
+	zero    func() IPMetadata
+	isValid func(IPMetadata) bool
+	get     func(m *resourceInfo) IPMetadata
+	set     func(m *resourceInfo, v IPMetadata)
+
+	// logConflict, if non-nil, is invoked by logConflicts() whenever two
+	// resources disagree on the value of this kind for the same prefix.
+	// It is handed the full resourceInfo for both sides (rather than just
+	// the bare values) so that it may pull in other fields (e.g. priority)
+	// for context.
+	logConflict func(scopedLog *logrus.Entry, winner, loser *resourceInfo, winnerResourceID, loserResourceID types.ResourceID)
+}
+
+// metadataKinds holds every IPMetadata kind that has been registered via
+// RegisterMetadataKind, keyed by its concrete (non-interface) type.
+var metadataKinds = map[reflect.Type]ipMetadataKind{}
+
+// RegisterMetadataKind registers a new kind of IPMetadata that may be
+// injected into the IPCache via UpsertMetadata, so that merge(), unmerge(),
+// isValid() and logConflicts() know how to handle it without this file
+// needing a dedicated type switch case for it. This allows subsystems (e.g.
+// encryption, tunneling, or a future policy or MTU hint) to plug their own
+// metadata into the IPCache from their own package, and allows tests to
+// register synthetic kinds.
+//
+// zero must return the value that indicates this kind is absent from a
+// resourceInfo. isValid reports whether a given value should be considered
+// present. get/set, if both non-nil, must read from and write to wherever T's
+// state lives on resourceInfo; this is only used by the built-in kinds below,
+// which already have a dedicated field. Any other kind should pass nil for
+// both, in which case RegisterMetadataKind stores it in resourceInfo.extra,
+// keyed by T's type -- no change to resourceInfo is required.
+// logConflict may be nil if this kind cannot conflict between resources of
+// the same source (e.g. because, unlike encryption keys or tunnel peers,
+// there can only ever be one value per prefix).
+//
+// RegisterMetadataKind panics if T has already been registered, so it must
+// only be called once per type, typically from an init() function.
+func RegisterMetadataKind[T IPMetadata](
+	zero func() T,
+	isValid func(T) bool,
+	get func(m *resourceInfo) T,
+	set func(m *resourceInfo, v T),
+	logConflict func(scopedLog *logrus.Entry, winner, loser *resourceInfo, winnerResourceID, loserResourceID types.ResourceID),
+) {
+	if (get == nil) != (set == nil) {
+		panic("RegisterMetadataKind: get and set must either both be nil or both be provided")
+	}
+
+	t := reflect.TypeOf(zero())
+	if _, exists := metadataKinds[t]; exists {
+		panic(fmt.Sprintf("IPMetadata kind %s already registered", t))
+	}
+
+	if get == nil {
+		get = func(m *resourceInfo) T {
+			v, ok := m.extra[t]
+			if !ok {
+				return zero()
+			}
+			return v.(T)
+		}
+		set = func(m *resourceInfo, v T) {
+			if m.extra == nil {
+				m.extra = make(map[reflect.Type]IPMetadata, 1)
+			}
+			m.extra[t] = v
+		}
+	}
+
+	metadataKinds[t] = ipMetadataKind{
+		zero:        func() IPMetadata { return zero() },
+		isValid:     func(v IPMetadata) bool { return isValid(v.(T)) },
+		get:         func(m *resourceInfo) IPMetadata { return get(m) },
+		set:         func(m *resourceInfo, v IPMetadata) { set(m, v.(T)) },
+		logConflict: logConflict,
+	}
+}
+
+func init() {
+	RegisterMetadataKind[labels.Labels](
+		func() labels.Labels { return nil },
+		func(v labels.Labels) bool { return v != nil },
+		func(m *resourceInfo) labels.Labels { return m.labels },
+		func(m *resourceInfo, v labels.Labels) { m.labels = labels.NewFrom(v) },
+		nil, // conflicting labels are merged together, not reported as a conflict
+	)
+
+	RegisterMetadataKind[overrideIdentity](
+		func() overrideIdentity { return false },
+		func(v overrideIdentity) bool { return bool(v) },
+		func(m *resourceInfo) overrideIdentity { return m.identityOverride },
+		func(m *resourceInfo, v overrideIdentity) { m.identityOverride = v },
+		nil, // identityOverride conflicts have bespoke handling in logConflicts, see identityOverride()
+	)
+
+	RegisterMetadataKind[types.TunnelPeer](
+		func() types.TunnelPeer { return types.TunnelPeer{} },
+		func(v types.TunnelPeer) bool { return v.IsValid() },
+		func(m *resourceInfo) types.TunnelPeer { return m.tunnelPeer },
+		func(m *resourceInfo, v types.TunnelPeer) { m.tunnelPeer = v },
+		func(scopedLog *logrus.Entry, winner, loser *resourceInfo, winnerResourceID, loserResourceID types.ResourceID) {
+			scopedLog.WithFields(logrus.Fields{
+				logfields.TunnelPeer:            winner.tunnelPeer.String(),
+				logfields.Resource:              winnerResourceID,
+				logfields.Priority:              winner.priority,
+				logfields.ConflictingTunnelPeer: loser.tunnelPeer.String(),
+				logfields.ConflictingResource:   loserResourceID,
+				logfields.ConflictingPriority:   loser.priority,
+			}).Warning("Detected conflicting tunnel peer for prefix. " +
+				"This may cause connectivity issues for this address.")
+		},
+	)
+
+	RegisterMetadataKind[types.EncryptKey](
+		func() types.EncryptKey { return types.EncryptKeyEmpty },
+		func(v types.EncryptKey) bool { return v.IsValid() },
+		func(m *resourceInfo) types.EncryptKey { return m.encryptKey },
+		func(m *resourceInfo, v types.EncryptKey) { m.encryptKey = v },
+		func(scopedLog *logrus.Entry, winner, loser *resourceInfo, winnerResourceID, loserResourceID types.ResourceID) {
+			scopedLog.WithFields(logrus.Fields{
+				logfields.Key:                 winner.encryptKey.String(),
+				logfields.Resource:            winnerResourceID,
+				logfields.Priority:            winner.priority,
+				logfields.ConflictingKey:      loser.encryptKey.String(),
+				logfields.ConflictingResource: loserResourceID,
+				logfields.ConflictingPriority: loser.priority,
+			}).Warning("Detected conflicting encryption key index for prefix. " +
+				"This may cause connectivity issues for this address.")
+		},
+	)
+
+	// Priority never makes a resourceInfo valid on its own: it is only
+	// consulted to order resources that are already valid for some other
+	// reason, so isValid unconditionally returns false here.
+	RegisterMetadataKind[types.Priority](
+		func() types.Priority { return types.PriorityDefault },
+		func(types.Priority) bool { return false },
+		func(m *resourceInfo) types.Priority { return m.priority },
+		func(m *resourceInfo, v types.Priority) { m.priority = v },
+		nil, // priority has no value of its own to conflict over
+	)
+}
+
 // merge overwrites the field in 'resourceInfo' corresponding to 'info'. This
 // associates the new information with the prefix and ResourceID that this
 // 'resourceInfo' resides under in the outer metadata map.
 func (m *resourceInfo) merge(info IPMetadata, src source.Source) {
-	switch info := info.(type) {
-	case labels.Labels:
-		m.labels = labels.NewFrom(info)
-	case overrideIdentity:
-		m.identityOverride = info
-	case types.TunnelPeer:
-		m.tunnelPeer = info
-	case types.EncryptKey:
-		m.encryptKey = info
-	default:
+	kind, ok := metadataKinds[reflect.TypeOf(info)]
+	if !ok {
 		log.Errorf("BUG: Invalid IPMetadata passed to ipinfo.merge(): %+v", info)
 		return
 	}
+	kind.set(m, info)
 	m.source = src
 }
 
 // unmerge removes the info of the specified type from 'resourceInfo'.
 func (m *resourceInfo) unmerge(info IPMetadata) {
-	switch info.(type) {
-	case labels.Labels:
-		m.labels = nil
-	case overrideIdentity:
-		m.identityOverride = false
-	case types.TunnelPeer:
-		m.tunnelPeer = types.TunnelPeer{}
-	case types.EncryptKey:
-		m.encryptKey = types.EncryptKeyEmpty
-	default:
+	kind, ok := metadataKinds[reflect.TypeOf(info)]
+	if !ok {
 		log.Errorf("BUG: Invalid IPMetadata passed to ipinfo.unmerge(): %+v", info)
 		return
 	}
+	kind.set(m, kind.zero())
 }
 
 func (m *resourceInfo) isValid() bool {
-	if m.labels != nil {
-		return true
-	}
-	if m.identityOverride {
-		return true
-	}
-	if m.tunnelPeer.IsValid() {
-		return true
-	}
-	if m.encryptKey.IsValid() {
-		return true
+	for _, kind := range metadataKinds {
+		if kind.isValid(kind.get(m)) {
+			return true
+		}
 	}
 	return false
 }
@@ -114,11 +253,28 @@ func (s prefixInfo) isValid() bool {
 	return false
 }
 
+// sortedByResourceIDsAndSource orders resourceIDs such that the
+// 'best' one, i.e. the one whose metadata should win when multiple
+// resources conflict, comes first. Ties are broken, in order, by:
+// source.Source (via source.AllowOverwrite), then by the explicit
+// types.Priority a caller attached via UpsertMetadata (higher wins,
+// defaulting to types.PriorityDefault), then by ResourceID.
 func (s prefixInfo) sortedByResourceIDsAndSource() []types.ResourceID {
 	resourceIDs := maps.Keys(s)
 	slices.Sort(resourceIDs)
-	slices.SortFunc(resourceIDs, func(a, b types.ResourceID) bool {
-		return !source.AllowOverwrite(s[a].source, s[b].source)
+	slices.SortStableFunc(resourceIDs, func(a, b types.ResourceID) bool {
+		infoA, infoB := s[a], s[b]
+		aOverB, bOverA := source.AllowOverwrite(infoA.source, infoB.source), source.AllowOverwrite(infoB.source, infoA.source)
+		if aOverB != bOverA {
+			return !aOverB
+		}
+		// Same source rank: higher priority wins. If priorities also
+		// tie, fall through and preserve the ResourceID-ascending order
+		// already established by the sort above.
+		if infoA.priority != infoB.priority {
+			return infoA.priority > infoB.priority
+		}
+		return false
 	})
 	return resourceIDs
 }
@@ -165,57 +321,52 @@ func (s prefixInfo) TunnelPeer() types.TunnelPeer {
 // the prefix info. If no override identity is present, this returns nil.
 // This pre-determined identity will overwrite any other identity which may
 // be derived from the prefix labels.
+//
+// If multiple resources set conflicting overrides for the same prefix, the
+// winner is picked the same way as for any other kind: by
+// sortedByResourceIDsAndSource (source.Source, then types.Priority, then
+// ResourceID). The conflict itself is logged below in logConflicts.
 func (s prefixInfo) identityOverride() (lbls labels.Labels, hasOverride bool) {
-	identities := make([]labels.Labels, 0, 1)
-	for _, info := range s {
+	for _, resourceID := range s.sortedByResourceIDsAndSource() {
+		info := s[resourceID]
 		// We emit a warning in logConflicts if an identity override
 		// was requested without labels
 		if info.identityOverride && len(info.labels) > 0 {
-			identities = append(identities, info.labels)
+			return info.labels, true
 		}
 	}
 
-	// No override identity present
-	if len(identities) == 0 {
-		return nil, false
-	}
-
-	// Conflict-resolution: We pick the labels with the alphabetically
-	// lowest value when formatted in the KV store format. The conflict
-	// is logged below in logConflicts.
-	if len(identities) > 1 {
-		sort.Slice(identities, func(i, j int) bool {
-			a := identities[i].SortedList()
-			b := identities[j].SortedList()
-			return bytes.Compare(a, b) == -1
-		})
-	}
-
-	return identities[0], true
+	return nil, false
 }
 
 func (s prefixInfo) logConflicts(scopedLog *logrus.Entry) {
 	var (
-		override           labels.Labels
+		override           *resourceInfo
 		overrideResourceID types.ResourceID
-
-		tunnelPeer           types.TunnelPeer
-		tunnelPeerResourceID types.ResourceID
-
-		encryptKey           types.EncryptKey
-		encryptKeyResourceID types.ResourceID
 	)
 
+	// winners tracks, for each registered IPMetadata kind, the first valid
+	// value seen so far (in sortedByResourceIDsAndSource order) along with
+	// the resourceInfo and ResourceID it came from. Any later valid value
+	// of the same kind is, by definition, a conflict.
+	winners := make(map[reflect.Type]*resourceInfo, len(metadataKinds))
+	winnerIDs := make(map[reflect.Type]types.ResourceID, len(metadataKinds))
+
 	for _, resourceID := range s.sortedByResourceIDsAndSource() {
 		info := s[resourceID]
 
+		// identityOverride has bespoke conflict handling below, since
+		// unlike the other kinds it is only "valid" in combination with
+		// a non-empty set of labels.
 		if info.identityOverride {
-			if len(override) > 0 {
+			if override != nil {
 				scopedLog.WithFields(logrus.Fields{
-					logfields.Identity:            override.String(),
+					logfields.Identity:            override.labels.String(),
 					logfields.Resource:            overrideResourceID,
+					logfields.Priority:            override.priority,
 					logfields.ConflictingIdentity: info.labels.String(),
 					logfields.ConflictingResource: resourceID,
+					logfields.ConflictingPriority: info.priority,
 				}).Warning("Detected conflicting identity override for prefix. " +
 					"This may cause connectivity issues for this address.")
 			}
@@ -228,39 +379,21 @@ func (s prefixInfo) logConflicts(scopedLog *logrus.Entry) {
 					"Falling back on the old non-override labels. " +
 					"This may cause connectivity issues for this address.")
 			} else {
-				override = info.labels
+				override = info
 				overrideResourceID = resourceID
 			}
 		}
 
-		if info.tunnelPeer.IsValid() {
-			if tunnelPeer.IsValid() {
-				scopedLog.WithFields(logrus.Fields{
-					logfields.TunnelPeer:            tunnelPeer.String(),
-					logfields.Resource:              tunnelPeerResourceID,
-					logfields.ConflictingTunnelPeer: info.tunnelPeer.String(),
-					logfields.ConflictingResource:   resourceID,
-				}).Warning("Detected conflicting tunnel peer for prefix. " +
-					"This may cause connectivity issues for this address.")
-			} else {
-				tunnelPeer = info.tunnelPeer
-				tunnelPeerResourceID = resourceID
+		for t, kind := range metadataKinds {
+			if kind.logConflict == nil || !kind.isValid(kind.get(info)) {
+				continue
 			}
-		}
-
-		if info.encryptKey.IsValid() {
-			if encryptKey.IsValid() {
-				scopedLog.WithFields(logrus.Fields{
-					logfields.Key:                 encryptKey.String(),
-					logfields.Resource:            encryptKeyResourceID,
-					logfields.ConflictingKey:      info.encryptKey.String(),
-					logfields.ConflictingResource: resourceID,
-				}).Warning("Detected conflicting encryption key index for prefix. " +
-					"This may cause connectivity issues for this address.")
-			} else {
-				encryptKey = info.encryptKey
-				encryptKeyResourceID = resourceID
+			if winner, ok := winners[t]; ok {
+				kind.logConflict(scopedLog, winner, info, winnerIDs[t], resourceID)
+				continue
 			}
+			winners[t] = info
+			winnerIDs[t] = resourceID
 		}
 	}
 }
@@ -0,0 +1,26 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package types
+
+import "strconv"
+
+// Priority is an optional, explicit ordering hint that a resource can attach
+// to the metadata it contributes for a prefix (see UpsertMetadata). It is
+// consulted only to break ties between two resources of the same
+// source.Source that both set a given kind of metadata (e.g. EncryptKey or
+// TunnelPeer) for the same prefix; a higher Priority wins.
+//
+// The default, zero Priority is used by every caller that doesn't explicitly
+// set one, so existing callers keep their current (ResourceID-ordered)
+// behavior unchanged.
+// This type implements ipcache.IPMetadata.
+type Priority int
+
+// PriorityDefault is the Priority assigned to a resource that does not
+// explicitly set one via UpsertMetadata.
+const PriorityDefault Priority = 0
+
+func (p Priority) String() string {
+	return strconv.Itoa(int(p))
+}
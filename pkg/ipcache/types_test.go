@@ -4,11 +4,17 @@
 package ipcache
 
 import (
+	"net/netip"
 	"testing"
 
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/cilium/cilium/pkg/ipcache/types"
+	"github.com/cilium/cilium/pkg/labels"
+	"github.com/cilium/cilium/pkg/logging/logfields"
 	"github.com/cilium/cilium/pkg/source"
 )
 
@@ -39,3 +45,207 @@ func Test_sortedByResourceIDsAndSource(t *testing.T) {
 	expected := []types.ResourceID{"endpoints-uid", "daemon-uid", "node2-uid", "node-uid", "identity-uid", "generated-uid", "a-restored-uid"}
 	assert.Equal(t, expected, pi.sortedByResourceIDsAndSource())
 }
+
+// Test_sortedByResourceIDsAndSource_priority covers the case the plain
+// source/ResourceID ordering can't: two resources of the *same* source
+// disagreeing on a prefix. Priority, when set, must break the tie instead of
+// falling back on arbitrary ResourceID order.
+func Test_sortedByResourceIDsAndSource_priority(t *testing.T) {
+	pi := make(prefixInfo, 3)
+	pi["aaa-low-uid"] = &resourceInfo{
+		source:   source.CustomResource,
+		priority: 1,
+	}
+	pi["zzz-high-uid"] = &resourceInfo{
+		source:   source.CustomResource,
+		priority: 10,
+	}
+	pi["mmm-unset-uid"] = &resourceInfo{
+		source: source.CustomResource,
+	}
+
+	// Alphabetically, mmm < zzz, but priority must win over ResourceID.
+	expected := []types.ResourceID{"zzz-high-uid", "aaa-low-uid", "mmm-unset-uid"}
+	assert.Equal(t, expected, pi.sortedByResourceIDsAndSource())
+}
+
+// Test_EncryptKey_priority covers EncryptKey(), which resolves a conflict
+// between two same-source resources by walking sortedByResourceIDsAndSource()
+// and returning the first valid entry -- i.e. the higher-priority one.
+func Test_EncryptKey_priority(t *testing.T) {
+	pi := make(prefixInfo, 2)
+	pi["aaa-low-uid"] = &resourceInfo{
+		source:     source.CustomResource,
+		priority:   1,
+		encryptKey: types.EncryptKey(5),
+	}
+	pi["zzz-high-uid"] = &resourceInfo{
+		source:     source.CustomResource,
+		priority:   10,
+		encryptKey: types.EncryptKey(7),
+	}
+
+	assert.Equal(t, types.EncryptKey(7), pi.EncryptKey())
+}
+
+// Test_TunnelPeer_priority is the TunnelPeer() counterpart to
+// Test_EncryptKey_priority.
+func Test_TunnelPeer_priority(t *testing.T) {
+	low := types.TunnelPeer{Addr: netip.MustParseAddr("192.0.2.1")}
+	high := types.TunnelPeer{Addr: netip.MustParseAddr("192.0.2.2")}
+
+	pi := make(prefixInfo, 2)
+	pi["aaa-low-uid"] = &resourceInfo{
+		source:     source.CustomResource,
+		priority:   1,
+		tunnelPeer: low,
+	}
+	pi["zzz-high-uid"] = &resourceInfo{
+		source:     source.CustomResource,
+		priority:   10,
+		tunnelPeer: high,
+	}
+
+	assert.Equal(t, high, pi.TunnelPeer())
+}
+
+// Test_identityOverride_priority covers identityOverride(), which returns the
+// labels of the first resource in sortedByResourceIDsAndSource() order that
+// sets an override with labels. Two resources of the same source set conflicting overrides; priority, not
+// alphabetical label content, must pick the winner.
+func Test_identityOverride_priority(t *testing.T) {
+	pi := make(prefixInfo, 2)
+	pi["aaa-low-uid"] = &resourceInfo{
+		source:           source.CustomResource,
+		priority:         1,
+		identityOverride: true,
+		labels:           labels.NewLabelsFromModel([]string{"aaa=low"}),
+	}
+	pi["zzz-high-uid"] = &resourceInfo{
+		source:           source.CustomResource,
+		priority:         10,
+		identityOverride: true,
+		labels:           labels.NewLabelsFromModel([]string{"zzz=high"}),
+	}
+
+	// Alphabetically "aaa=low" sorts first, but priority 10 must win.
+	lbls, hasOverride := pi.identityOverride()
+	assert.True(t, hasOverride)
+	assert.Equal(t, pi["zzz-high-uid"].labels, lbls)
+}
+
+// Test_logConflicts_priority_encryptKey asserts that an EncryptKey conflict
+// between two same-source resources logs both sides' priority.
+func Test_logConflicts_priority_encryptKey(t *testing.T) {
+	logger, hook := logrustest.NewNullLogger()
+	scopedLog := logrus.NewEntry(logger)
+
+	pi := make(prefixInfo, 2)
+	pi["aaa-low-uid"] = &resourceInfo{
+		source:     source.CustomResource,
+		priority:   1,
+		encryptKey: types.EncryptKey(5),
+	}
+	pi["zzz-high-uid"] = &resourceInfo{
+		source:     source.CustomResource,
+		priority:   10,
+		encryptKey: types.EncryptKey(7),
+	}
+
+	pi.logConflicts(scopedLog)
+
+	require.Len(t, hook.AllEntries(), 1)
+	entry := hook.LastEntry()
+	assert.Equal(t, logrus.WarnLevel, entry.Level)
+	assert.Equal(t, types.Priority(10), entry.Data[logfields.Priority])
+	assert.Equal(t, types.Priority(1), entry.Data[logfields.ConflictingPriority])
+}
+
+// Test_logConflicts_priority_tunnelPeer is the TunnelPeer counterpart to
+// Test_logConflicts_priority_encryptKey.
+func Test_logConflicts_priority_tunnelPeer(t *testing.T) {
+	logger, hook := logrustest.NewNullLogger()
+	scopedLog := logrus.NewEntry(logger)
+
+	pi := make(prefixInfo, 2)
+	pi["aaa-low-uid"] = &resourceInfo{
+		source:     source.CustomResource,
+		priority:   1,
+		tunnelPeer: types.TunnelPeer{Addr: netip.MustParseAddr("192.0.2.1")},
+	}
+	pi["zzz-high-uid"] = &resourceInfo{
+		source:     source.CustomResource,
+		priority:   10,
+		tunnelPeer: types.TunnelPeer{Addr: netip.MustParseAddr("192.0.2.2")},
+	}
+
+	pi.logConflicts(scopedLog)
+
+	require.Len(t, hook.AllEntries(), 1)
+	entry := hook.LastEntry()
+	assert.Equal(t, logrus.WarnLevel, entry.Level)
+	assert.Equal(t, types.Priority(10), entry.Data[logfields.Priority])
+	assert.Equal(t, types.Priority(1), entry.Data[logfields.ConflictingPriority])
+}
+
+// synthKind is a synthetic IPMetadata kind, registered below, used to
+// exercise RegisterMetadataKind without depending on any of the built-in
+// kinds. It deliberately has no dedicated field on resourceInfo: passing nil
+// get/set below makes RegisterMetadataKind fall back to resourceInfo.extra,
+// which is exactly what a kind defined in another package would do.
+type synthKind int
+
+func Test_RegisterMetadataKind(t *testing.T) {
+	RegisterMetadataKind[synthKind](
+		func() synthKind { return 0 },
+		func(v synthKind) bool { return v != 0 },
+		nil,
+		nil,
+		nil,
+	)
+
+	a := &resourceInfo{}
+	b := &resourceInfo{}
+	assert.False(t, a.isValid())
+	assert.False(t, b.isValid())
+
+	a.merge(synthKind(1), source.Local)
+	assert.True(t, a.isValid())
+	assert.Equal(t, source.Local, a.source)
+
+	// b must not see a's synthKind value: resourceInfo.extra is
+	// per-instance storage, not a package-level variable.
+	assert.False(t, b.isValid())
+
+	a.unmerge(synthKind(1))
+	assert.False(t, a.isValid())
+}
+
+func Test_RegisterMetadataKind_duplicate(t *testing.T) {
+	type dupKind int
+	register := func() {
+		RegisterMetadataKind[dupKind](
+			func() dupKind { return 0 },
+			func(v dupKind) bool { return v != 0 },
+			nil,
+			nil,
+			nil,
+		)
+	}
+
+	register()
+	assert.Panics(t, func() { register() })
+}
+
+func Test_RegisterMetadataKind_getSetMismatch(t *testing.T) {
+	type mismatchKind int
+	assert.Panics(t, func() {
+		RegisterMetadataKind[mismatchKind](
+			func() mismatchKind { return 0 },
+			func(v mismatchKind) bool { return v != 0 },
+			func(m *resourceInfo) mismatchKind { return 0 },
+			nil,
+			nil,
+		)
+	})
+}
@@ -0,0 +1,15 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package logfields
+
+const (
+	// Priority is the value of the types.Priority that won a per-prefix
+	// IPMetadata conflict (see pkg/ipcache's logConflicts).
+	Priority = "priority"
+
+	// ConflictingPriority is the value of the types.Priority on the losing
+	// side of a per-prefix IPMetadata conflict (see pkg/ipcache's
+	// logConflicts).
+	ConflictingPriority = "conflictingPriority"
+)